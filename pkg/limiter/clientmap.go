@@ -0,0 +1,202 @@
+package limiter
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultMaxClients and defaultIdleTTL bound a boundedClientMap's memory usage until
+// Configure is called to override them.
+const (
+	defaultMaxClients   = 100000
+	defaultJanitorSweep = time.Minute
+)
+
+const defaultIdleTTL = 10 * time.Minute
+
+var (
+	clientMapMu sync.Mutex
+	maxClients  = defaultMaxClients
+	idleTTL     = defaultIdleTTL
+	registry    []*boundedClientMap
+	janitorStop chan struct{}
+	janitorWG   sync.WaitGroup
+)
+
+// Configure bounds the per-client state every Limiter keeps (token bucket buckets, GCRA
+// arrival times, sliding window counters): at most maxClients entries are kept at once,
+// least-recently-used first, and an entry untouched for idleTTL is evicted even if
+// maxClients hasn't been reached. It also starts the background janitor goroutine that
+// performs the idleTTL sweep; call Stop to cancel it.
+func Configure(maxClientsCfg int, idleTTLCfg time.Duration) {
+	clientMapMu.Lock()
+	maxClients = maxClientsCfg
+	idleTTL = idleTTLCfg
+	clientMapMu.Unlock()
+	startJanitor()
+}
+
+// Stop cancels the background janitor goroutine started by Configure. It is safe to
+// call even if the janitor was never started.
+func Stop() {
+	clientMapMu.Lock()
+	stop := janitorStop
+	janitorStop = nil
+	clientMapMu.Unlock()
+	if stop != nil {
+		close(stop)
+		janitorWG.Wait()
+	}
+}
+
+func startJanitor() {
+	clientMapMu.Lock()
+	defer clientMapMu.Unlock()
+	if janitorStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	janitorStop = stop
+	janitorWG.Add(1)
+	go func() {
+		defer janitorWG.Done()
+		ticker := time.NewTicker(defaultJanitorSweep)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				sweepAll()
+			}
+		}
+	}()
+}
+
+func sweepAll() {
+	clientMapMu.Lock()
+	maps := append([]*boundedClientMap(nil), registry...)
+	ttl := idleTTL
+	clientMapMu.Unlock()
+	for _, m := range maps {
+		m.sweep(ttl)
+	}
+}
+
+// clientMapEntry is one key's value plus the bookkeeping boundedClientMap needs for
+// LRU ordering and idle-TTL eviction.
+type clientMapEntry struct {
+	key        string
+	value      interface{}
+	lastAccess time.Time
+}
+
+// boundedClientMap is a string-keyed map bounded by maxClients (evicting the
+// least-recently-used entry on overflow) and idleTTL (evicting entries the janitor
+// finds untouched for too long). It replaces the unbounded sync.Maps every Limiter
+// implementation used to keep one entry per client forever.
+type boundedClientMap struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List // front = most recently used, back = least recently used
+}
+
+func newBoundedClientMap() *boundedClientMap {
+	m := &boundedClientMap{items: make(map[string]*list.Element), lru: list.New()}
+	clientMapMu.Lock()
+	registry = append(registry, m)
+	clientMapMu.Unlock()
+	return m
+}
+
+// unregister drops m from registry so the janitor stops sweeping it and it can be
+// garbage collected once nothing else references it. Called when the Limiter or Store
+// that owns m is replaced or discarded, e.g. a rule being reconfigured or reset.
+func unregister(m *boundedClientMap) {
+	clientMapMu.Lock()
+	defer clientMapMu.Unlock()
+	for i, candidate := range registry {
+		if candidate == m {
+			registry[i] = registry[len(registry)-1]
+			registry[len(registry)-1] = nil
+			registry = registry[:len(registry)-1]
+			return
+		}
+	}
+}
+
+// LoadOrStore returns the existing value for key if present (touching it as
+// recently-used), otherwise stores value and returns it, evicting the
+// least-recently-used entry first if this insert would exceed maxClients.
+func (m *boundedClientMap) LoadOrStore(key string, value interface{}) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.items[key]; ok {
+		entry := el.Value.(*clientMapEntry)
+		entry.lastAccess = time.Now()
+		m.lru.MoveToFront(el)
+		return entry.value, true
+	}
+
+	entry := &clientMapEntry{key: key, value: value, lastAccess: time.Now()}
+	m.items[key] = m.lru.PushFront(entry)
+	m.evictOverflow()
+	return value, false
+}
+
+// Load returns the current value for key, touching it as recently-used.
+func (m *boundedClientMap) Load(key string) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*clientMapEntry)
+	entry.lastAccess = time.Now()
+	m.lru.MoveToFront(el)
+	return entry.value, true
+}
+
+// evictOverflow removes least-recently-used entries until len(items) <= maxClients.
+// Callers must hold m.mu.
+func (m *boundedClientMap) evictOverflow() {
+	clientMapMu.Lock()
+	limit := maxClients
+	clientMapMu.Unlock()
+	if limit <= 0 {
+		return
+	}
+	for len(m.items) > limit {
+		oldest := m.lru.Back()
+		if oldest == nil {
+			return
+		}
+		entry := oldest.Value.(*clientMapEntry)
+		delete(m.items, entry.key)
+		m.lru.Remove(oldest)
+	}
+}
+
+// sweep evicts every entry idle for longer than ttl. The LRU list is ordered
+// most-recently-used to least, so it can stop at the first entry that's still fresh.
+func (m *boundedClientMap) sweep(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().Add(-ttl)
+	for el := m.lru.Back(); el != nil; {
+		entry := el.Value.(*clientMapEntry)
+		if entry.lastAccess.After(cutoff) {
+			return
+		}
+		prev := el.Prev()
+		delete(m.items, entry.key)
+		m.lru.Remove(el)
+		el = prev
+	}
+}
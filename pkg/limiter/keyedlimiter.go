@@ -0,0 +1,64 @@
+package limiter
+
+import (
+	"net/http"
+	"time"
+)
+
+// KeyFunc extracts the key a KeyedLimiter should rate limit by from an HTTP request.
+// Unlike ClientIDFunc (used by Middleware before the handler runs), a KeyFunc is
+// typically called after the handler has parsed the request body, e.g. to key by a
+// decoded username or tenant ID rather than a header.
+type KeyFunc func(r *http.Request) string
+
+// KeyedLimiterOption configures a KeyedLimiter built by NewLimiter.
+type KeyedLimiterOption func(*KeyedLimiter)
+
+// WithKeyFunc sets the KeyFunc OnLimit falls back to when called with an empty key.
+func WithKeyFunc(fn KeyFunc) KeyedLimiterOption {
+	return func(kl *KeyedLimiter) { kl.keyFunc = fn }
+}
+
+// KeyedLimiter is a standalone Limiter a handler can hold directly, instead of going
+// through the package-global rule set, so it can pick the rate limit key itself -
+// typically after parsing the request body (rate limit /login by decoded username,
+// /upload by tenant found in the JSON payload, etc).
+type KeyedLimiter struct {
+	limiter Limiter
+	keyFunc KeyFunc
+}
+
+// NewLimiter builds a KeyedLimiter enforcing maxRequests per unit using the default
+// SlidingWindow strategy, independent of any rule registered with AddRule/AddRuleFor.
+func NewLimiter(maxRequests int64, unit time.Duration, opts ...KeyedLimiterOption) *KeyedLimiter {
+	kl := &KeyedLimiter{limiter: newSlidingWindowLimiter(maxRequests, unit)}
+	for _, opt := range opts {
+		opt(kl)
+	}
+	return kl
+}
+
+// Allow reports whether the request keyed by key may proceed, the same as Limiter.Allow.
+func (kl *KeyedLimiter) Allow(key string) (bool, time.Duration, Reservation) {
+	return kl.limiter.Allow(key)
+}
+
+// OnLimit checks whether key is rate limited and, if so, writes the 429 response
+// (including the X-RateLimit-Reset header) itself and returns true - the caller should
+// stop handling the request. If key is empty, it falls back to the KeyFunc configured
+// via WithKeyFunc. If the request is allowed, OnLimit leaves w untouched and returns
+// false so the caller can keep handling the request.
+func (kl *KeyedLimiter) OnLimit(w http.ResponseWriter, r *http.Request, key string) bool {
+	if key == "" && kl.keyFunc != nil {
+		key = kl.keyFunc(r)
+	}
+
+	allowed, retryAfter, _ := kl.limiter.Allow(key)
+	if allowed {
+		return false
+	}
+
+	w.Header().Set("X-RateLimit-Reset", retryAfter.String())
+	w.WriteHeader(http.StatusTooManyRequests)
+	return true
+}
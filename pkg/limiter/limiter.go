@@ -1,6 +1,8 @@
 package limiter
 
 import (
+	"math"
+	"sort"
 	"sync"
 	"time"
 )
@@ -9,116 +11,495 @@ import (
 // RULES for rate limiting
 /////////////////////////////////////////////////////////////////
 
-// Rule encapsulates max requests per unit of time.
+// Strategy selects the rate limiting algorithm used to build a Limiter.
+type Strategy int
+
+const (
+	// SlidingWindow is a sliding window counter that weights the previous
+	// window's count by its overlap with the current window.
+	SlidingWindow Strategy = iota
+	// TokenBucket refills tokens at a constant rate up to a configurable burst,
+	// similar to golang.org/x/time/rate.
+	TokenBucket
+	// GCRA (Generic Cell Rate Algorithm) stores a single "theoretical arrival
+	// time" per client and computes allow/deny plus retry-after in O(1).
+	GCRA
+)
+
+// Rule encapsulates max requests per unit of time for a given Strategy.
 // Example: For 10 requests per second, maxRequests = 10, unit = time.Second
 // Example: For 100 requests per minute, maxRequests = 100, unit = time.Minute
-// TODO Allow rules to be created per service-request types
-// TODO Allow rules to be deleted
-// TODO Store rules in a separate RDBMS
 type Rule struct {
+	strategy    Strategy
 	maxRequests int64
 	unit        time.Duration
+	burst       int64
+}
+
+// Scope identifies where a Rule applies. A zero-value field matches anything, so
+// Scope{} is the global scope that every request falls under. Scopes are matched in
+// specificity order (most non-empty fields wins); see RuleSet.match.
+type Scope struct {
+	// Path scopes the rule to a single route, e.g. "/endpoint-0"
+	Path string
+	// Method scopes the rule to a single HTTP method, e.g. "GET"
+	Method string
+	// Tier scopes the rule to a client tier, e.g. "free" or "premium"
+	Tier string
+}
+
+// specificity counts how many fields of the scope are pinned down; used to order
+// matching rules so the most specific one wins.
+func (s Scope) specificity() int {
+	n := 0
+	if s.Path != "" {
+		n++
+	}
+	if s.Method != "" {
+		n++
+	}
+	if s.Tier != "" {
+		n++
+	}
+	return n
+}
+
+// matches reports whether the scope applies to the given request context. Empty
+// fields are wildcards.
+func (s Scope) matches(ctx RequestContext) bool {
+	if s.Path != "" && s.Path != ctx.Path {
+		return false
+	}
+	if s.Method != "" && s.Method != ctx.Method {
+		return false
+	}
+	if s.Tier != "" && s.Tier != ctx.Tags["tier"] {
+		return false
+	}
+	return true
+}
+
+// RequestContext carries what a caller (typically pkg/server) knows about an
+// incoming request so it can be matched against scoped rules.
+type RequestContext struct {
+	ClientID string
+	Path     string
+	Method   string
+	Tags     map[string]string
 }
 
-// Using this global as a cache
-var rule *Rule
+// MatchMode controls how multiple matching rules are combined for a single request.
+type MatchMode int
+
+const (
+	// MatchMostSpecific evaluates only the single most specific matching rule.
+	MatchMostSpecific MatchMode = iota
+	// MatchAllMustPass evaluates every matching rule and requires all to allow.
+	MatchAllMustPass
+)
+
+// SetMatchMode changes how overlapping rule scopes are combined. Defaults to
+// MatchMostSpecific.
+func SetMatchMode(mode MatchMode) {
+	matchMode = mode
+}
+
+var matchMode = MatchMostSpecific
+
+// RuleStore is an optional hook for persisting rules outside the process, e.g. in an
+// RDBMS, so a fleet of servers can share the same rule configuration. When unset,
+// rules only live in the in-memory RuleSet.
+type RuleStore interface {
+	Save(scope Scope, rule *Rule) error
+	Delete(scope Scope) error
+	LoadAll() (map[Scope]*Rule, error)
+}
+
+var ruleStore RuleStore
+
+// SetRuleStore configures a persistent RuleStore and loads any rules it already has
+// into the in-memory RuleSet. Pass nil to go back to pure in-memory rules.
+func SetRuleStore(store RuleStore) error {
+	ruleStore = store
+	if store == nil {
+		return nil
+	}
+	loaded, err := store.LoadAll()
+	if err != nil {
+		return err
+	}
+	for scope, r := range loaded {
+		rules.register(scope, r)
+	}
+	return nil
+}
+
+// ruleConfig pairs a registered Rule with the Limiter built from it.
+type ruleConfig struct {
+	scope   Scope
+	rule    *Rule
+	limiter Limiter
+}
+
+// RuleSet is a concurrent, hierarchical store of Rules keyed by Scope.
+type RuleSet struct {
+	rules sync.Map // Scope -> *ruleConfig
+}
 
-// AddRule Create a global rule to set max request per unit of time. See block comments above Rule type for more details
+var rules = &RuleSet{}
+
+func (rs *RuleSet) register(scope Scope, r *Rule) {
+	if old, loaded := rs.rules.Load(scope); loaded {
+		releaseLimiter(old.(*ruleConfig).limiter)
+	}
+	rs.rules.Store(scope, &ruleConfig{scope: scope, rule: r, limiter: newLimiter(r)})
+	if ruleStore != nil {
+		// Best-effort persistence; in-memory registration has already succeeded so a
+		// store failure here does not affect serving traffic.
+		_ = ruleStore.Save(scope, r)
+	}
+}
+
+func (rs *RuleSet) delete(scope Scope) {
+	if old, loaded := rs.rules.Load(scope); loaded {
+		releaseLimiter(old.(*ruleConfig).limiter)
+	}
+	rs.rules.Delete(scope)
+	if ruleStore != nil {
+		_ = ruleStore.Delete(scope)
+	}
+}
+
+func (rs *RuleSet) list() []Scope {
+	var scopes []Scope
+	rs.rules.Range(func(k, _ interface{}) bool {
+		scopes = append(scopes, k.(Scope))
+		return true
+	})
+	return scopes
+}
+
+// match returns every ruleConfig whose scope applies to ctx, most specific first.
+func (rs *RuleSet) match(ctx RequestContext) []*ruleConfig {
+	var matched []*ruleConfig
+	rs.rules.Range(func(_, v interface{}) bool {
+		rc := v.(*ruleConfig)
+		if rc.scope.matches(ctx) {
+			matched = append(matched, rc)
+		}
+		return true
+	})
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].scope.specificity() > matched[j].scope.specificity()
+	})
+	return matched
+}
+
+// reset rebuilds every registered Limiter from its Rule, clearing per-client state
+// without forgetting which rules are configured.
+func (rs *RuleSet) reset() {
+	rs.rules.Range(func(k, v interface{}) bool {
+		rc := v.(*ruleConfig)
+		rs.rules.Store(k, &ruleConfig{scope: rc.scope, rule: rc.rule, limiter: newLimiter(rc.rule)})
+		releaseLimiter(rc.limiter)
+		return true
+	})
+}
+
+// releasable is implemented by Limiters (and Stores) that hold a boundedClientMap, so
+// releaseLimiter can drop it from the registry once the rule backing it is replaced or
+// discarded.
+type releasable interface {
+	release()
+}
+
+// releaseLimiter drops l's per-client state from the registry the janitor sweeps, if l
+// (or the Store behind it) holds any. Called whenever a ruleConfig's Limiter is
+// superseded or discarded, so reconfiguring or resetting rules doesn't leak
+// boundedClientMaps forever.
+func releaseLimiter(l Limiter) {
+	if r, ok := l.(releasable); ok {
+		r.release()
+	}
+}
+
+// AddRule Create a global rule (applies to every client, path and method) to set max
+// requests per unit of time using the default SlidingWindow strategy. See block
+// comments above Rule type for more details
 func AddRule(maxRequests int64, unit time.Duration) {
-	rule = &Rule{
+	AddRuleFor(Scope{}, maxRequests, unit)
+}
+
+// AddRuleWithStrategy Create a global rule using the given Strategy. burst is only
+// consulted by strategies that support bursting (TokenBucket, GCRA); when omitted it
+// defaults to maxRequests.
+func AddRuleWithStrategy(strategy Strategy, maxRequests int64, unit time.Duration, burst ...int64) {
+	AddRuleForWithStrategy(Scope{}, strategy, maxRequests, unit, burst...)
+}
+
+// AddRuleFor registers a SlidingWindow rule scoped to scope, e.g. a single endpoint,
+// HTTP method or client tier. The most specific matching scope wins at request time
+// (see MatchMode).
+func AddRuleFor(scope Scope, maxRequests int64, unit time.Duration) {
+	AddRuleForWithStrategy(scope, SlidingWindow, maxRequests, unit)
+}
+
+// AddRuleForWithStrategy registers a rule scoped to scope using the given Strategy.
+func AddRuleForWithStrategy(scope Scope, strategy Strategy, maxRequests int64, unit time.Duration, burst ...int64) {
+	b := maxRequests
+	if len(burst) > 0 {
+		b = burst[0]
+	}
+	rules.register(scope, &Rule{
+		strategy:    strategy,
 		maxRequests: maxRequests,
 		unit:        unit,
+		burst:       b,
+	})
+}
+
+// DeleteRule removes the rule registered at scope, if any.
+func DeleteRule(scope Scope) {
+	rules.delete(scope)
+}
+
+// ListRules returns the scope of every currently registered rule.
+func ListRules() []Scope {
+	return rules.list()
+}
+
+// newLimiter builds the Limiter implementation configured by r.
+func newLimiter(r *Rule) Limiter {
+	switch r.strategy {
+	case TokenBucket:
+		return newTokenBucketLimiter(r.maxRequests, r.unit, r.burst)
+	case GCRA:
+		return newGCRALimiter(r.maxRequests, r.unit, r.burst)
+	default:
+		return newSlidingWindowLimiter(r.maxRequests, r.unit)
 	}
 }
 
 /////////////////////////////////////////////////////////////////
-// RATE LIMITER based on Sliding Window Counter algorithm
+// LIMITER interface and shared types
 /////////////////////////////////////////////////////////////////
 
-// Limiter implements Sliding Window Counter algorithm.
-// This package uses clientLimiterMap to track Sliding window counters per client. A new sliding window counter pair
-// is created for each new client.
-// TODO Memory management to evict least recently used clients to disk if memory thresholds are exceeded
-type Limiter struct {
-	// Start of the previous window
-	prevWindow time.Time
-	// numRequests seen in the previous window
-	prevCounter int64
-	// Start of the current window
-	currWindow time.Time
-	// numRequests seen so far in the current window
-	currCounter int64
-	// mutex to synchronize access to per client limiter
-	lock sync.Mutex
+// Reservation describes the outcome of a single Allow decision for a client.
+type Reservation struct {
+	// Allowed is true if the request may proceed.
+	Allowed bool
+	// RetryAfter is how long the caller should wait before the request would
+	// be allowed. It is only meaningful when Allowed is false.
+	RetryAfter time.Duration
 }
 
-var clientLimiterMap sync.Map
+// Limiter decides whether a client's request can proceed under some rate
+// limiting algorithm. Implementations are safe for concurrent use and track
+// per-client state internally, keyed by clientId.
+type Limiter interface {
+	// Allow returns true if the client's request can be processed, otherwise
+	// false if it is rate limited. It also returns the duration left before
+	// the next request would be allowed (-1 if not meaningful) and the
+	// Reservation describing the decision.
+	Allow(clientId string) (bool, time.Duration, Reservation)
+}
 
-// AllowRequest Returns true if the client's request can be processed, otherwise false if it is rate limited
-// Also returns the duration left for the current window to expire. The duration will be -1 if no rule has been
-// configured
-func AllowRequest(clientId string) (bool, time.Duration) {
+// AllowRequest Returns true if the request described by ctx can be processed, otherwise
+// false if it is rate limited. Also returns the duration left before the request would
+// be allowed. The duration will be -1 if no rule matched ctx.
+//
+// Every registered rule whose Scope matches ctx is a candidate; by default
+// (MatchMostSpecific) only the most specific one is evaluated, but SetMatchMode(MatchAllMustPass)
+// requires every matching rule to allow the request.
+func AllowRequest(ctx RequestContext) (bool, time.Duration) {
+	matched := rules.match(ctx)
 	// Allow by default to protect from limiter errors making server unavailable
-	if rule == nil {
+	if len(matched) == 0 {
 		return true, time.Duration(-1)
 	}
+	return evaluateRules(matched, ctx.ClientID)
+}
 
-	// Check if limiter counters exists for the given client
-	var l *Limiter
-	if val, ok := clientLimiterMap.Load(clientId); ok {
-		l = val.(*Limiter)
-	} else {
-		l = &Limiter{}
-		clientLimiterMap.Store(clientId, l)
+// ResetLimiter Clear all limiters without forgetting configured rules
+func ResetLimiter() {
+	rules.reset()
+}
+
+/////////////////////////////////////////////////////////////////
+// RATE LIMITER based on Sliding Window Counter algorithm
+/////////////////////////////////////////////////////////////////
+
+// slidingWindowLimiter implements Sliding Window Counter algorithm. Counters for the
+// previous and current window are kept in a Store so that, when Store is a shared
+// backend (e.g. Redis), multiple pkg/server processes see the same per-client state.
+// The default in-process Store bounds its memory via Configure(maxClients, idleTTL).
+type slidingWindowLimiter struct {
+	maxRequests int64
+	unit        time.Duration
+	store       Store
+}
+
+func newSlidingWindowLimiter(maxRequests int64, unit time.Duration) *slidingWindowLimiter {
+	s := store
+	if s == nil {
+		s = newInProcessStore(unit)
 	}
-	return l.Allow()
+	return &slidingWindowLimiter{maxRequests: maxRequests, unit: unit, store: s}
 }
 
-func (l *Limiter) Allow() (bool, time.Duration) {
+func (l *slidingWindowLimiter) Allow(clientId string) (bool, time.Duration, Reservation) {
 	now := time.Now()
-	newCurrWindow := now.Truncate(rule.unit)
-	newPrevWindow := newCurrWindow.Add(-rule.unit) // time.Sub() says use time.Add(-d) for t-d
-	newCurrCounter := int64(0)
-	newPrevCounter := int64(0)
-
-	func() {
-		// Instead of using new kv pairs for the new windows, we will reuse the existing window counters for which we
-		// need to lock the following. Lock can be avoided by storing new kv pairs and a separate go-routine to clean
-		// up older windows
-		l.lock.Lock()
-		defer l.lock.Unlock()
-
-		if newCurrWindow == l.currWindow {
-			// The current window is still active, increament the corresponding counter
-			l.currCounter++
-		} else {
-			if newPrevWindow == l.currWindow {
-				// We moved one window. Make the existing current window as the previous window
-				l.prevWindow = l.currWindow
-				l.prevCounter = l.currCounter
-			} else {
-				// We have moved many windows ahead. Reset the previous window
-				l.prevWindow = time.Time{}
-				l.prevCounter = 0
-			}
-			// Start the new current window
-			l.currWindow = newCurrWindow
-			l.currCounter = 0
-		}
+	currWindow := now.Truncate(l.unit)
 
-		newCurrWindow = l.currWindow
-		newPrevWindow = l.prevWindow
-		newCurrCounter = l.currCounter
-		newPrevCounter = l.prevCounter
-	}()
+	// The 2*unit TTL covers both the current window and the previous one it overlaps with, so a
+	// Redis-backed store can expire counters on its own rather than requiring a sweep.
+	currCounter, err := l.store.IncrCounter(clientId, currWindow, 2*l.unit)
+	if err != nil {
+		// Allow by default to protect from store errors making the limiter unavailable
+		return true, time.Duration(-1), Reservation{Allowed: true, RetryAfter: time.Duration(-1)}
+	}
+
+	prevCounter, _, err := l.store.LoadCounters(clientId, currWindow)
+	if err != nil {
+		// Fail open on the previous window too: undercounting is safer than rejecting
+		// requests because the store had a transient error.
+		prevCounter = 0
+	}
 
-	prevWindowOverlap := rule.unit - now.Sub(newCurrWindow)
-	prevWindowWeightedCounter := int64(float64(newPrevCounter) * (float64(prevWindowOverlap) / float64(rule.unit)))
-	activeNumRequests := prevWindowWeightedCounter + newCurrCounter
-	return activeNumRequests < rule.maxRequests, prevWindowOverlap
+	prevWindowOverlap := l.unit - now.Sub(currWindow)
+	prevWindowWeightedCounter := int64(float64(prevCounter) * (float64(prevWindowOverlap) / float64(l.unit)))
+	activeNumRequests := prevWindowWeightedCounter + currCounter
+	// currCounter already includes this request (IncrCounter above counted it), so the
+	// Nth request of the window is allowed when activeNumRequests == maxRequests, not just <.
+	allowed := activeNumRequests <= l.maxRequests
+	return allowed, prevWindowOverlap, Reservation{Allowed: allowed, RetryAfter: prevWindowOverlap}
 }
 
-// ResetLimiter Clear all limiters
-func ResetLimiter() {
-	clientLimiterMap = sync.Map{}
+// release drops l.store's boundedClientMap from the registry, if it has one private to
+// this limiter. A Store installed via SetStore (e.g. Redis) is shared across limiters and
+// doesn't implement releasable, so it is left alone.
+func (l *slidingWindowLimiter) release() {
+	if r, ok := l.store.(releasable); ok {
+		r.release()
+	}
+}
+
+/////////////////////////////////////////////////////////////////
+// RATE LIMITER based on Token Bucket algorithm
+/////////////////////////////////////////////////////////////////
+
+// tokenBucketLimiter implements the classic token bucket algorithm: tokens refill at a
+// constant rate up to a configurable burst capacity, and each allowed request consumes
+// one token.
+type tokenBucketLimiter struct {
+	// ratePerSec tokens added per second
+	ratePerSec float64
+	// burst is the maximum number of tokens the bucket can hold
+	burst   int64
+	clients *boundedClientMap
+}
+
+func newTokenBucketLimiter(maxRequests int64, unit time.Duration, burst int64) *tokenBucketLimiter {
+	return &tokenBucketLimiter{
+		ratePerSec: float64(maxRequests) / unit.Seconds(),
+		burst:      burst,
+		clients:    newBoundedClientMap(),
+	}
+}
+
+// tokenBucketState holds a single client's bucket.
+type tokenBucketState struct {
+	tokens     float64
+	lastRefill time.Time
+	lock       sync.Mutex
+}
+
+func (l *tokenBucketLimiter) Allow(clientId string) (bool, time.Duration, Reservation) {
+	val, _ := l.clients.LoadOrStore(clientId, &tokenBucketState{tokens: float64(l.burst), lastRefill: time.Now()})
+	s := val.(*tokenBucketState)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.lastRefill).Seconds()
+	s.tokens = math.Min(float64(l.burst), s.tokens+elapsed*l.ratePerSec)
+	s.lastRefill = now
+
+	if s.tokens >= 1 {
+		s.tokens--
+		return true, time.Duration(-1), Reservation{Allowed: true, RetryAfter: time.Duration(-1)}
+	}
+
+	// Not enough tokens: compute how long until one token is available
+	deficit := 1 - s.tokens
+	retryAfter := time.Duration(deficit/l.ratePerSec*float64(time.Second)) + 1
+	return false, retryAfter, Reservation{Allowed: false, RetryAfter: retryAfter}
+}
+
+func (l *tokenBucketLimiter) release() {
+	unregister(l.clients)
+}
+
+/////////////////////////////////////////////////////////////////
+// RATE LIMITER based on Generic Cell Rate Algorithm (GCRA)
+/////////////////////////////////////////////////////////////////
+
+// gcraLimiter implements GCRA. It stores only a single "theoretical arrival time" (TAT)
+// per client and computes allow/deny plus retry-after in O(1), giving smooth traffic
+// shaping without per-window resets.
+type gcraLimiter struct {
+	// emissionInterval is the minimum spacing between requests at the configured rate
+	emissionInterval time.Duration
+	// burstOffset is how far newTAT may exceed now before a request is rejected
+	burstOffset time.Duration
+	clients     *boundedClientMap
+}
+
+func newGCRALimiter(maxRequests int64, unit time.Duration, burst int64) *gcraLimiter {
+	if maxRequests < 1 {
+		maxRequests = 1
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	emissionInterval := time.Duration(int64(unit) / maxRequests)
+	return &gcraLimiter{
+		emissionInterval: emissionInterval,
+		burstOffset:      emissionInterval * time.Duration(burst),
+		clients:          newBoundedClientMap(),
+	}
+}
+
+// gcraState holds a single client's theoretical arrival time.
+type gcraState struct {
+	tat  time.Time
+	lock sync.Mutex
+}
+
+func (l *gcraLimiter) Allow(clientId string) (bool, time.Duration, Reservation) {
+	val, _ := l.clients.LoadOrStore(clientId, &gcraState{})
+	s := val.(*gcraState)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	tat := s.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(l.emissionInterval)
+
+	if newTAT.Sub(now) > l.burstOffset {
+		retryAfter := newTAT.Sub(now) - l.burstOffset
+		return false, retryAfter, Reservation{Allowed: false, RetryAfter: retryAfter}
+	}
+
+	s.tat = newTAT
+	return true, time.Duration(-1), Reservation{Allowed: true, RetryAfter: time.Duration(-1)}
+}
+
+func (l *gcraLimiter) release() {
+	unregister(l.clients)
 }
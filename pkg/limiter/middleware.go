@@ -0,0 +1,169 @@
+package limiter
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// evaluateRules applies matchMode to an already-matched, most-specific-first rule list
+// and reports whether clientId's request is allowed and how long to wait if not. It is
+// shared by AllowRequest and Middleware so both honor MatchMostSpecific/MatchAllMustPass
+// the same way.
+func evaluateRules(matched []*ruleConfig, clientId string) (bool, time.Duration) {
+	if matchMode != MatchAllMustPass {
+		allowed, retryAfter, _ := matched[0].limiter.Allow(clientId)
+		return allowed, retryAfter
+	}
+
+	allowed := true
+	retryAfter := time.Duration(-1)
+	for _, rc := range matched {
+		ok, retry, _ := rc.limiter.Allow(clientId)
+		if !ok {
+			allowed = false
+			if retry > retryAfter {
+				retryAfter = retry
+			}
+		}
+	}
+	return allowed, retryAfter
+}
+
+// Reserve decides whether clientId may proceed right now under the globally scoped rule
+// (Scope{}), without needing a full RequestContext. It always consults the limiter, so
+// (unlike AllowRequest with no rule configured) it counts towards the client's budget
+// whenever a global rule exists.
+func Reserve(clientId string) Reservation {
+	matched := rules.match(RequestContext{ClientID: clientId})
+	if len(matched) == 0 {
+		return Reservation{Allowed: true, RetryAfter: time.Duration(-1)}
+	}
+	_, _, res := matched[0].limiter.Allow(clientId)
+	return res
+}
+
+// Wait blocks until clientId's next request would be allowed under the globally scoped
+// rule, or until ctx is done. If the required wait is longer than maxDelay it does not
+// block at all and returns context.DeadlineExceeded at once; otherwise it returns
+// ctx.Err() if ctx is done first, and nil once the wait has been satisfied.
+func Wait(ctx context.Context, clientId string, maxDelay time.Duration) error {
+	res := Reserve(clientId)
+	if res.Allowed {
+		return nil
+	}
+	if res.RetryAfter < 0 || res.RetryAfter > maxDelay {
+		return context.DeadlineExceeded
+	}
+
+	timer := time.NewTimer(res.RetryAfter)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+/////////////////////////////////////////////////////////////////
+// MIDDLEWARE
+/////////////////////////////////////////////////////////////////
+
+// OnLimitFunc writes the response for a rate-limited request. X-RateLimit-* and
+// Retry-After headers have already been set by the time it's called; it only needs to
+// write the status code and, if desired, a body (e.g. JSON describing the error).
+type OnLimitFunc func(w http.ResponseWriter, r *http.Request, res Reservation)
+
+// ClientIDFunc extracts the client identifier used to look up per-client rate limit
+// state from an incoming request.
+type ClientIDFunc func(r *http.Request) string
+
+type middlewareConfig struct {
+	clientIDFunc ClientIDFunc
+	onLimit      OnLimitFunc
+}
+
+// MiddlewareOption configures Middleware.
+type MiddlewareOption func(*middlewareConfig)
+
+// WithClientIDFunc overrides how Middleware extracts a client ID from the request.
+func WithClientIDFunc(fn ClientIDFunc) MiddlewareOption {
+	return func(c *middlewareConfig) { c.clientIDFunc = fn }
+}
+
+// WithOnLimit overrides how Middleware responds when a request is rate limited.
+func WithOnLimit(fn OnLimitFunc) MiddlewareOption {
+	return func(c *middlewareConfig) { c.onLimit = fn }
+}
+
+func defaultOnLimit(w http.ResponseWriter, _ *http.Request, _ Reservation) {
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// SetRetryAfterHeaders sets the X-RateLimit-Reset header and, if retryAfter is positive,
+// the standard Retry-After header. Middleware uses this internally; callers that
+// integrate with a Limiter directly instead of through Middleware (e.g. pkg/server's
+// queued handler) can call it too, so a rejection looks the same regardless of path.
+func SetRetryAfterHeaders(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("X-RateLimit-Reset", retryAfter.String())
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+}
+
+// Middleware wraps next so callers (like pkg/server) no longer need to open-code
+// limiter integration: it matches the request against the configured rules, sets the
+// standard X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset and Retry-After
+// headers, and either calls next or the configured OnLimitFunc.
+func Middleware(next http.Handler, opts ...MiddlewareOption) http.Handler {
+	cfg := &middlewareConfig{
+		clientIDFunc: func(r *http.Request) string { return r.Header.Get("clientId") },
+		onLimit:      defaultOnLimit,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCtx := RequestContext{
+			ClientID: cfg.clientIDFunc(r),
+			Path:     r.URL.Path,
+			Method:   r.Method,
+		}
+
+		matched := rules.match(reqCtx)
+		if len(matched) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, retryAfter := evaluateRules(matched, reqCtx.ClientID)
+
+		// The most specific matched rule is what governs the headers; under
+		// MatchAllMustPass several rules decide allowed/retryAfter together but only one
+		// "Limit" can be reported. Remaining is limit-1 on every allowed request and 0 on a
+		// rejected one; it does not reflect how many requests the client has already made
+		// in the current window.
+		limit := matched[0].rule.maxRequests
+		remaining := int64(0)
+		if allowed {
+			remaining = limit - 1
+			if remaining < 0 {
+				remaining = 0
+			}
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+
+		if allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		SetRetryAfterHeaders(w, retryAfter)
+		cfg.onLimit(w, r, Reservation{Allowed: false, RetryAfter: retryAfter})
+	})
+}
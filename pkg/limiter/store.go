@@ -0,0 +1,164 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// counterMapKey encodes a (clientId, window) pair as the string key a boundedClientMap needs.
+func counterMapKey(clientId string, window time.Time) string {
+	return clientId + "|" + strconv.FormatInt(window.UnixNano(), 10)
+}
+
+// Store holds the sliding window counters a slidingWindowLimiter needs: the request
+// count for the previous window and the current one. The default Store is in-process
+// (boundedClientMap-backed), but SetStore can install a shared backend such as Redis so that
+// multiple pkg/server instances rate limit against the same counters.
+type Store interface {
+	// LoadCounters returns the request counts for the window preceding window and for
+	// window itself.
+	LoadCounters(clientId string, window time.Time) (prev, curr int64, err error)
+	// IncrCounter atomically increments the counter for (clientId, window) by one,
+	// arranging for it to expire after ttl, and returns its new value.
+	IncrCounter(clientId string, window time.Time, ttl time.Duration) (int64, error)
+}
+
+// store is the Store used by newly constructed sliding window limiters. Nil means
+// "use an in-process store private to that limiter".
+var store Store
+
+// SetStore installs s as the Store used by sliding window limiters created after this
+// call (existing limiters keep whatever store they were built with). Pass nil to go
+// back to a private in-process store per limiter.
+func SetStore(s Store) {
+	store = s
+}
+
+/////////////////////////////////////////////////////////////////
+// In-process Store
+/////////////////////////////////////////////////////////////////
+
+// counterEntry is a single window's counter. expiresAt mirrors the ttl passed to
+// IncrCounter; LoadCounters treats an expired entry as absent (count 0). The
+// boundedClientMap holding these already bounds their count and evicts idle ones, so
+// expiresAt only needs to cover the window math, not overall memory.
+type counterEntry struct {
+	lock      sync.Mutex
+	count     int64
+	expiresAt time.Time
+}
+
+// inProcessStore is the default Store: counters live only in this process's memory,
+// bounded by the same Configure(maxClients, idleTTL) every other Limiter respects.
+type inProcessStore struct {
+	unit     time.Duration
+	counters *boundedClientMap // counterMapKey(clientId, window) -> *counterEntry
+}
+
+func newInProcessStore(unit time.Duration) *inProcessStore {
+	return &inProcessStore{unit: unit, counters: newBoundedClientMap()}
+}
+
+func (s *inProcessStore) LoadCounters(clientId string, window time.Time) (int64, int64, error) {
+	return s.get(clientId, window.Add(-s.unit)), s.get(clientId, window), nil
+}
+
+func (s *inProcessStore) get(clientId string, window time.Time) int64 {
+	val, ok := s.counters.Load(counterMapKey(clientId, window))
+	if !ok {
+		return 0
+	}
+	e := val.(*counterEntry)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if time.Now().After(e.expiresAt) {
+		return 0
+	}
+	return e.count
+}
+
+func (s *inProcessStore) IncrCounter(clientId string, window time.Time, ttl time.Duration) (int64, error) {
+	val, _ := s.counters.LoadOrStore(counterMapKey(clientId, window), &counterEntry{})
+	e := val.(*counterEntry)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.count++
+	e.expiresAt = time.Now().Add(ttl)
+	return e.count, nil
+}
+
+// release drops s.counters from the registry. Implements the releasable interface
+// slidingWindowLimiter.release consults.
+func (s *inProcessStore) release() {
+	unregister(s.counters)
+}
+
+/////////////////////////////////////////////////////////////////
+// Redis-backed Store
+/////////////////////////////////////////////////////////////////
+
+// incrAndExpireScript atomically increments the counter at KEYS[1] and, only on the
+// first increment, sets its expiry to ARGV[1] milliseconds - so concurrent requests
+// from multiple pkg/server processes never race the INCR against the EXPIRE.
+var incrAndExpireScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// redisStore is a Store backed by Redis, letting multiple pkg/server processes share
+// sliding-window counters for the same clients.
+type redisStore struct {
+	client *redis.Client
+	unit   time.Duration
+	prefix string
+}
+
+// NewRedisStore builds a Store that keeps counters in Redis via client. unit must
+// match the Rule's unit so LoadCounters can derive the previous window's key.
+func NewRedisStore(client *redis.Client, unit time.Duration) *redisStore {
+	return &redisStore{client: client, unit: unit, prefix: "bkp1:limiter"}
+}
+
+func (s *redisStore) key(clientId string, window time.Time) string {
+	return fmt.Sprintf("%s:%s:%d", s.prefix, clientId, window.UnixNano())
+}
+
+func (s *redisStore) IncrCounter(clientId string, window time.Time, ttl time.Duration) (int64, error) {
+	res, err := incrAndExpireScript.Run(context.Background(), s.client, []string{s.key(clientId, window)}, ttl.Milliseconds()).Result()
+	if err != nil {
+		return 0, err
+	}
+	count, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("limiter: unexpected redis response type %T for INCR", res)
+	}
+	return count, nil
+}
+
+func (s *redisStore) LoadCounters(clientId string, window time.Time) (int64, int64, error) {
+	vals, err := s.client.MGet(context.Background(), s.key(clientId, window.Add(-s.unit)), s.key(clientId, window)).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseCount(vals[0]), parseCount(vals[1]), nil
+}
+
+func parseCount(v interface{}) int64 {
+	str, ok := v.(string)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// queuePollInterval is how often a queued request re-checks whether the limiter would
+// now admit it.
+const queuePollInterval = 10 * time.Millisecond
+
+// ticket represents one request waiting in a client's queue. cancel is closed to
+// head-drop it: the goroutine blocked on it responds immediately instead of continuing
+// to wait.
+type ticket struct {
+	cancel chan struct{}
+	elem   *list.Element
+}
+
+// clientQueue is the bounded FIFO of tickets a single client currently has waiting.
+type clientQueue struct {
+	lock    sync.Mutex
+	tickets *list.List
+}
+
+var clientQueues sync.Map // clientId -> *clientQueue
+
+// enqueue adds a new ticket for clientId, head-dropping (cancelling) the oldest queued
+// ticket first if the queue is already at depth. depth <= 0 means unbounded.
+func enqueue(clientId string, depth int) (t *ticket, headDropped bool) {
+	val, _ := clientQueues.LoadOrStore(clientId, &clientQueue{tickets: list.New()})
+	q := val.(*clientQueue)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if depth > 0 && q.tickets.Len() >= depth {
+		if front := q.tickets.Front(); front != nil {
+			oldest := front.Value.(*ticket)
+			close(oldest.cancel)
+			q.tickets.Remove(front)
+			headDropped = true
+		}
+	}
+
+	t = &ticket{cancel: make(chan struct{})}
+	t.elem = q.tickets.PushBack(t)
+	return t, headDropped
+}
+
+// dequeue removes t from clientId's queue once it has been served, timed out, or
+// cancelled by a later head-drop.
+func dequeue(clientId string, t *ticket) {
+	val, ok := clientQueues.Load(clientId)
+	if !ok {
+		return
+	}
+	q := val.(*clientQueue)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.tickets.Remove(t.elem)
+}
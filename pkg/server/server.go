@@ -16,15 +16,50 @@ const ClientId = "clientId"
 var handlers []func(w http.ResponseWriter, req *http.Request)
 var m *http.ServeMux
 
-type clientMetric struct {
-	NumAccepted int
-	NumRejected int
+type ClientMetric struct {
+	NumAccepted    int
+	NumRejected    int
+	NumQueued      int
+	NumHeadDropped int
+	NumTimedOut    int
 }
 
 var clientMetricMap sync.Map
 
+// serverConfig holds the options CreateHttpServers was called with.
+type serverConfig struct {
+	// queueDepth <= 0 means requests that don't fit the rate limit are rejected
+	// immediately with 429, same as before queuing existed.
+	queueDepth int
+	maxWait    time.Duration
+}
+
+// ServerOption configures CreateHttpServers.
+type ServerOption func(*serverConfig)
+
+// WithQueue enables queuing mode: instead of rejecting a rate-limited request outright,
+// it waits up to maxWait for the limiter to admit it. Each client gets its own bounded
+// queue of depth requests; once a client's queue is full, the oldest queued request for
+// that client is head-dropped (woken up and rejected) to make room, so queueing latency
+// for that client stays bounded under sustained overload.
+func WithQueue(depth int, maxWait time.Duration) ServerOption {
+	return func(c *serverConfig) {
+		c.queueDepth = depth
+		c.maxWait = maxWait
+	}
+}
+
 // Create 'numServers' HTTP servers
-func CreateHttpServers(numServers int) {
+func CreateHttpServers(numServers int, opts ...ServerOption) {
+	cfg := &serverConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	// handlers is rebuilt from scratch alongside m below; otherwise a second call in the
+	// same process would append past the previous call's entries and the indices handed
+	// to m.HandleFunc would point at stale handlers instead of the ones just built.
+	handlers = nil
 	m = http.NewServeMux()
 	s := http.Server{Addr: fmt.Sprintf(":%v", ServerPort), Handler: m}
 	m.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
@@ -38,19 +73,11 @@ func CreateHttpServers(numServers int) {
 
 	for ii := 0; ii < numServers; ii++ {
 		jj := ii
-		fn := func(w http.ResponseWriter, req *http.Request) {
-			clientId := req.Header.Get(ClientId)
-			allowRequest, timeLeft := limiter.AllowRequest(clientId)
-			if allowRequest {
-				now := time.Now()
-				reportMetric(clientId, true)
-				_, _ = fmt.Fprintf(w, "[C-%v -> S-%v] ALLOWED at %v", clientId, jj, now.String())
-			} else {
-				reportMetric(clientId, false)
-				w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%v", timeLeft))
-				w.WriteHeader(http.StatusTooManyRequests)
-				return
-			}
+		var fn func(w http.ResponseWriter, req *http.Request)
+		if cfg.queueDepth > 0 {
+			fn = queuedHandler(jj, cfg)
+		} else {
+			fn = directHandler(jj)
 		}
 		handlers = append(handlers, fn)
 		m.HandleFunc(fmt.Sprintf("/endpoint-%v", jj), handlers[jj])
@@ -63,6 +90,84 @@ func CreateHttpServers(numServers int) {
 	}()
 }
 
+// directHandler rejects a rate-limited request immediately with 429, via limiter.Middleware.
+func directHandler(serverId int) func(w http.ResponseWriter, req *http.Request) {
+	serve := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		respondAllowed(w, req, serverId)
+	})
+	return limiter.Middleware(serve,
+		limiter.WithClientIDFunc(func(req *http.Request) string { return req.Header.Get(ClientId) }),
+		limiter.WithOnLimit(func(w http.ResponseWriter, req *http.Request, res limiter.Reservation) {
+			reportMetric(req.Header.Get(ClientId), false)
+			w.WriteHeader(http.StatusTooManyRequests)
+		}),
+	).ServeHTTP
+}
+
+// queuedHandler holds a rate-limited request on its client's bounded queue, polling the
+// limiter until it's admitted, cfg.maxWait elapses (NumTimedOut), or it gets head-dropped
+// to make room for a newer request from the same client (NumHeadDropped).
+func queuedHandler(serverId int, cfg *serverConfig) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		clientId := req.Header.Get(ClientId)
+		reqCtx := limiter.RequestContext{ClientID: clientId, Path: req.URL.Path, Method: req.Method}
+
+		allowed, retryAfter := limiter.AllowRequest(reqCtx)
+		if allowed {
+			respondAllowed(w, req, serverId)
+			return
+		}
+
+		// The ticket this call head-drops (if any) is some other, earlier goroutine's -
+		// it notices via its own <-t.cancel case below and reports NumHeadDropped itself.
+		t, _ := enqueue(clientId, cfg.queueDepth)
+		defer dequeue(clientId, t)
+		reportQueued(clientId)
+
+		deadline := time.NewTimer(cfg.maxWait)
+		defer deadline.Stop()
+		ticker := time.NewTicker(queuePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.cancel:
+				reportHeadDropped(clientId)
+				reportMetric(clientId, false)
+				respondRateLimited(w, retryAfter)
+				return
+			case <-deadline.C:
+				reportTimedOut(clientId)
+				reportMetric(clientId, false)
+				respondRateLimited(w, retryAfter)
+				return
+			case <-ticker.C:
+				ok, retry := limiter.AllowRequest(reqCtx)
+				if ok {
+					respondAllowed(w, req, serverId)
+					return
+				}
+				retryAfter = retry
+			}
+		}
+	}
+}
+
+func respondAllowed(w http.ResponseWriter, req *http.Request, serverId int) {
+	clientId := req.Header.Get(ClientId)
+	now := time.Now()
+	reportMetric(clientId, true)
+	_, _ = fmt.Fprintf(w, "[C-%v -> S-%v] ALLOWED at %v", clientId, serverId, now.String())
+}
+
+// respondRateLimited writes a 429 with the same X-RateLimit-Reset/Retry-After headers
+// limiter.Middleware sets, so a queued request that's ultimately rejected (head-dropped
+// or timed out) looks the same to a client as one rejected by the direct path.
+func respondRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	limiter.SetRetryAfterHeaders(w, retryAfter)
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
 // Shutdown the HTTP server
 func Shutdown() {
 	_, err := http.Get(fmt.Sprintf("http://localhost:%v/shutdown", ServerPort))
@@ -77,26 +182,51 @@ func Shutdown() {
 // Metrics
 ////////////////////////////////////////////////////////////////
 
-// Used by server to track accepted and rejected requests per client
-func reportMetric(id string, accepted bool) {
-	val := clientMetric{}
+// updateMetric loads id's current ClientMetric, applies mutate, and stores the result.
+func updateMetric(id string, mutate func(*ClientMetric)) {
+	val := ClientMetric{}
 	if v, ok := clientMetricMap.Load(id); ok {
-		val = v.(clientMetric)
-	}
-	if accepted {
-		val.NumAccepted++
-	} else {
-		val.NumRejected++
+		val = v.(ClientMetric)
 	}
+	mutate(&val)
 	clientMetricMap.Store(id, val)
 }
 
+// Used by server to track accepted and rejected requests per client
+func reportMetric(id string, accepted bool) {
+	updateMetric(id, func(m *ClientMetric) {
+		if accepted {
+			m.NumAccepted++
+		} else {
+			m.NumRejected++
+		}
+	})
+}
+
+// reportQueued records that id's request was placed on its client queue.
+func reportQueued(id string) {
+	updateMetric(id, func(m *ClientMetric) { m.NumQueued++ })
+}
+
+// reportHeadDropped records that id's oldest queued request was dropped to make room
+// for a newer one.
+func reportHeadDropped(id string) {
+	updateMetric(id, func(m *ClientMetric) { m.NumHeadDropped++ })
+}
+
+// reportTimedOut records that id's queued request waited out its full maxWait without
+// being admitted.
+func reportTimedOut(id string) {
+	updateMetric(id, func(m *ClientMetric) { m.NumTimedOut++ })
+}
+
 func PrintMetric() {
 	totalAccepted := 0
 	totalRejected := 0
 	clientMetricMap.Range(func(k, v interface{}) bool {
-		val := v.(clientMetric)
-		fmt.Printf("C-%v => accepted:%v, rejected:%v\n", k, val.NumAccepted, val.NumRejected)
+		val := v.(ClientMetric)
+		fmt.Printf("C-%v => accepted:%v, rejected:%v, queued:%v, headDropped:%v, timedOut:%v\n",
+			k, val.NumAccepted, val.NumRejected, val.NumQueued, val.NumHeadDropped, val.NumTimedOut)
 		totalAccepted += val.NumAccepted
 		totalRejected += val.NumRejected
 		return true
@@ -108,3 +238,12 @@ func PrintMetric() {
 func ResetMetric() {
 	clientMetricMap = sync.Map{}
 }
+
+// GetMetric returns id's current metric snapshot, the zero value if nothing has been
+// recorded for it yet.
+func GetMetric(id string) ClientMetric {
+	if v, ok := clientMetricMap.Load(id); ok {
+		return v.(ClientMetric)
+	}
+	return ClientMetric{}
+}
@@ -3,14 +3,21 @@ package limiter_test
 import (
 	"bkp1/pkg/limiter"
 	"bkp1/pkg/server"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"sort"
 	"sync"
 	"testing"
 	"time"
+
+	redis "github.com/redis/go-redis/v9"
 )
 
 // This test code can be used to validate rate limiting as follows:
@@ -70,6 +77,391 @@ func TestE2ELimiter(t *testing.T) {
 	server.Shutdown()
 }
 
+// TestE2ELimiterDistributedStore exercises the same flow as TestE2ELimiter but backs the
+// sliding window counters with Redis via limiter.SetStore, standing in for multiple
+// pkg/server processes that would otherwise each keep their own in-process counters and
+// under-enforce the rule. Skips if no Redis is reachable on localhost:6379.
+func TestE2ELimiterDistributedStore(t *testing.T) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer func() {
+		_ = redisClient.Close()
+	}()
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("redis not reachable on localhost:6379, skipping distributed store test: %v", err)
+	}
+
+	numServers := 2
+	numClients := 3
+	numRequests := 20
+
+	limiter.SetStore(limiter.NewRedisStore(redisClient, time.Second))
+	defer limiter.SetStore(nil)
+
+	server.CreateHttpServers(numServers)
+	limiter.AddRule(5, time.Second)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for ii := 0; ii < numClients; ii++ {
+		wg.Add(1)
+		clientId := ii
+		go func() {
+			defer wg.Done()
+			for jj := 0; jj < numRequests; jj++ {
+				serverEndpoint := rand.Intn(numServers)
+				_, status, timeLeft := sendClientRequest(clientId, serverEndpoint)
+				if status == http.StatusTooManyRequests && timeLeft > 0 {
+					fmt.Printf("Too many requests, timeLeft=%v\n", timeLeft)
+					time.Sleep(timeLeft)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	server.PrintMetric()
+	fmt.Printf("Time taken %v\n", time.Since(start))
+	server.Shutdown()
+}
+
+// BenchmarkLimiterManyClients drives AllowRequest with a fresh client ID on every
+// iteration, simulating a workload with millions of unique clients. Configure bounds
+// the per-client state each Limiter keeps, so memory stays flat instead of growing with
+// b.N; run with -benchmem to see it.
+func BenchmarkLimiterManyClients(b *testing.B) {
+	limiter.Configure(10000, time.Minute)
+	defer limiter.Stop()
+	limiter.AddRuleWithStrategy(limiter.TokenBucket, 100, time.Second)
+
+	ctx := limiter.RequestContext{Path: "/bench", Method: "GET"}
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		ctx.ClientID = fmt.Sprintf("client-%d", ii)
+		limiter.AllowRequest(ctx)
+	}
+}
+
+// TestTokenBucketStrategy exercises the TokenBucket strategy directly through
+// AllowRequest: the burst is allowed, the next request is rejected with a positive
+// retry-after, and waiting that long refills a token for the request after that.
+func TestTokenBucketStrategy(t *testing.T) {
+	scope := limiter.Scope{Path: "/tokenbucket"}
+	limiter.AddRuleForWithStrategy(scope, limiter.TokenBucket, 2, time.Second)
+	defer limiter.DeleteRule(scope)
+
+	ctx := limiter.RequestContext{ClientID: "tb-client", Path: "/tokenbucket", Method: "GET"}
+	for ii := 0; ii < 2; ii++ {
+		if allowed, _ := limiter.AllowRequest(ctx); !allowed {
+			t.Fatalf("expected request %d to be allowed by the fresh bucket", ii)
+		}
+	}
+
+	allowed, retryAfter := limiter.AllowRequest(ctx)
+	if allowed {
+		t.Fatal("expected the request to be rejected once the bucket is empty")
+	}
+	if retryAfter <= 0 {
+		t.Fatalf("expected a positive retry-after, got %v", retryAfter)
+	}
+
+	time.Sleep(retryAfter)
+	if allowed, _ := limiter.AllowRequest(ctx); !allowed {
+		t.Fatal("expected a request to be allowed again once retryAfter has elapsed")
+	}
+}
+
+// TestGCRAStrategy exercises the GCRA strategy directly through AllowRequest: the burst
+// is allowed, the next request is rejected with a positive retry-after, and waiting that
+// long lets the theoretical arrival time catch back up so traffic can resume.
+func TestGCRAStrategy(t *testing.T) {
+	scope := limiter.Scope{Path: "/gcra"}
+	limiter.AddRuleForWithStrategy(scope, limiter.GCRA, 2, time.Second)
+	defer limiter.DeleteRule(scope)
+
+	ctx := limiter.RequestContext{ClientID: "gcra-client", Path: "/gcra", Method: "GET"}
+	for ii := 0; ii < 2; ii++ {
+		if allowed, _ := limiter.AllowRequest(ctx); !allowed {
+			t.Fatalf("expected request %d to be allowed within the burst", ii)
+		}
+	}
+
+	allowed, retryAfter := limiter.AllowRequest(ctx)
+	if allowed {
+		t.Fatal("expected the request to be rejected once the burst is exhausted")
+	}
+	if retryAfter <= 0 {
+		t.Fatalf("expected a positive retry-after, got %v", retryAfter)
+	}
+
+	time.Sleep(retryAfter)
+	if allowed, _ := limiter.AllowRequest(ctx); !allowed {
+		t.Fatal("expected a request to be allowed again once retryAfter has elapsed")
+	}
+}
+
+// TestScopeSpecificityAndRuleManagement exercises Scope-based rule registration: a more
+// specific scope wins over a less specific one that also matches, ListRules reports every
+// registered scope, and DeleteRule removes one without disturbing the others.
+func TestScopeSpecificityAndRuleManagement(t *testing.T) {
+	globalScope := limiter.Scope{Path: "/scoped"}
+	specificScope := limiter.Scope{Path: "/scoped", Method: "POST"}
+
+	limiter.AddRuleFor(globalScope, 10, time.Second)
+	limiter.AddRuleFor(specificScope, 1, time.Second)
+	defer limiter.DeleteRule(globalScope)
+	defer limiter.DeleteRule(specificScope)
+
+	scopes := limiter.ListRules()
+	found := map[limiter.Scope]bool{}
+	for _, s := range scopes {
+		found[s] = true
+	}
+	if !found[globalScope] || !found[specificScope] {
+		t.Fatalf("expected ListRules to report both registered scopes, got %v", scopes)
+	}
+
+	postCtx := limiter.RequestContext{ClientID: "scoped-client", Path: "/scoped", Method: "POST"}
+	if allowed, _ := limiter.AllowRequest(postCtx); !allowed {
+		t.Fatal("expected the first POST request to be allowed by the specific rule's burst")
+	}
+	if allowed, _ := limiter.AllowRequest(postCtx); allowed {
+		t.Fatal("expected the second POST request to be rejected: the more specific rule (1/sec) should win over the global one (10/sec)")
+	}
+
+	getCtx := limiter.RequestContext{ClientID: "scoped-client", Path: "/scoped", Method: "GET"}
+	if allowed, _ := limiter.AllowRequest(getCtx); !allowed {
+		t.Fatal("expected a GET request, which only matches the global scope, to still have budget there")
+	}
+
+	limiter.DeleteRule(specificScope)
+	for _, s := range limiter.ListRules() {
+		if s == specificScope {
+			t.Fatalf("expected DeleteRule to remove the specific scope, still found it in %v", limiter.ListRules())
+		}
+	}
+}
+
+// TestMatchAllMustPass exercises SetMatchMode(MatchAllMustPass): when several scopes
+// match a request, every one must allow it, not just the most specific.
+func TestMatchAllMustPass(t *testing.T) {
+	limiter.SetMatchMode(limiter.MatchAllMustPass)
+	defer limiter.SetMatchMode(limiter.MatchMostSpecific)
+
+	globalScope := limiter.Scope{Path: "/mustpass"}
+	specificScope := limiter.Scope{Path: "/mustpass", Method: "POST"}
+	limiter.AddRuleFor(globalScope, 1, time.Second)
+	limiter.AddRuleFor(specificScope, 10, time.Second)
+	defer limiter.DeleteRule(globalScope)
+	defer limiter.DeleteRule(specificScope)
+
+	ctx := limiter.RequestContext{ClientID: "mustpass-client", Path: "/mustpass", Method: "POST"}
+	if allowed, _ := limiter.AllowRequest(ctx); !allowed {
+		t.Fatal("expected the first request to be allowed by both rules")
+	}
+	if allowed, _ := limiter.AllowRequest(ctx); allowed {
+		t.Fatal("expected the second request to be rejected: the global rule (1/sec) must also pass under MatchAllMustPass, even though the specific rule (10/sec) still has budget")
+	}
+}
+
+// TestReserve exercises Reserve directly against the globally scoped rule: within burst
+// it's allowed immediately, and once exhausted it reports a positive RetryAfter.
+func TestReserve(t *testing.T) {
+	limiter.AddRule(2, time.Second)
+	defer limiter.DeleteRule(limiter.Scope{})
+
+	clientId := "reserve-client"
+	for ii := 0; ii < 2; ii++ {
+		if res := limiter.Reserve(clientId); !res.Allowed {
+			t.Fatalf("expected request %d to be allowed within burst", ii)
+		}
+	}
+
+	res := limiter.Reserve(clientId)
+	if res.Allowed {
+		t.Fatal("expected the request to be rejected once the burst is exhausted")
+	}
+	if res.RetryAfter <= 0 {
+		t.Fatalf("expected a positive RetryAfter, got %v", res.RetryAfter)
+	}
+}
+
+// TestWait exercises Wait against the globally scoped rule: it returns immediately while
+// budget remains, reports context.DeadlineExceeded when maxDelay can't cover the
+// required wait, and otherwise blocks roughly that long before returning nil.
+func TestWait(t *testing.T) {
+	limiter.AddRule(1, time.Second)
+	defer limiter.DeleteRule(limiter.Scope{})
+
+	clientId := "wait-client"
+
+	if err := limiter.Wait(context.Background(), clientId, time.Second); err != nil {
+		t.Fatalf("expected the first Wait to succeed immediately, got %v", err)
+	}
+
+	if err := limiter.Wait(context.Background(), clientId, 0); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded when maxDelay can't cover the wait, got %v", err)
+	}
+
+	// RetryAfter is how long is left in the current window, which depends on wall-clock
+	// alignment rather than anything this test controls; read it right before the real
+	// Wait call below so the two are measuring the same moment.
+	res := limiter.Reserve(clientId)
+	if res.Allowed || res.RetryAfter <= 0 {
+		t.Fatalf("expected the window to still be exhausted with a positive RetryAfter, got %+v", res)
+	}
+
+	start := time.Now()
+	if err := limiter.Wait(context.Background(), clientId, res.RetryAfter+time.Second); err != nil {
+		t.Fatalf("expected Wait to block until allowed and then succeed, got %v", err)
+	}
+	// RetryAfter only shrinks between the Reserve above and Wait's own internal check, so
+	// this is a one-sided bound: Wait should never take meaningfully longer than what we
+	// already observed was left in the window.
+	if elapsed := time.Since(start); elapsed > res.RetryAfter+250*time.Millisecond {
+		t.Fatalf("expected Wait to return within roughly RetryAfter=%v, took %v", res.RetryAfter, elapsed)
+	}
+}
+
+// TestMiddlewareHeaders exercises Middleware directly: it sets X-RateLimit-Limit and
+// X-RateLimit-Remaining on every response, and X-RateLimit-Reset plus Retry-After on one
+// it rejects.
+func TestMiddlewareHeaders(t *testing.T) {
+	scope := limiter.Scope{Path: "/mw-headers"}
+	limiter.AddRuleFor(scope, 1, time.Second)
+	defer limiter.DeleteRule(scope)
+
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/mw-headers", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the first request to be allowed, got status %v", w.Code)
+	}
+	if got := w.Header().Get("X-RateLimit-Limit"); got != "1" {
+		t.Fatalf("expected X-RateLimit-Limit=1, got %q", got)
+	}
+	if got := w.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Fatalf("expected X-RateLimit-Remaining=0 after consuming the only token, got %q", got)
+	}
+
+	w2 := httptest.NewRecorder()
+	handler.ServeHTTP(w2, httptest.NewRequest("GET", "/mw-headers", nil))
+	if w2.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second request to be rejected, got status %v", w2.Code)
+	}
+	if got := w2.Header().Get("X-RateLimit-Reset"); got == "" {
+		t.Fatal("expected X-RateLimit-Reset to be set on a rejected request")
+	}
+	if got := w2.Header().Get("Retry-After"); got == "" {
+		t.Fatal("expected Retry-After to be set on a rejected request")
+	}
+}
+
+// TestE2ELimiterByPayloadField rate limits a /login-style endpoint by the decoded
+// username field instead of a header, using limiter.NewLimiter directly rather than the
+// package-global rule set Middleware consults.
+func TestE2ELimiterByPayloadField(t *testing.T) {
+	loginLimiter := limiter.NewLimiter(3, time.Second)
+
+	loginHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if loginLimiter.OnLimit(w, r, body.Username) {
+			return
+		}
+		_, _ = fmt.Fprintf(w, "logged in as %v", body.Username)
+	})
+
+	ts := httptest.NewServer(loginHandler)
+	defer ts.Close()
+
+	login := func(username string) int {
+		payload, _ := json.Marshal(map[string]string{"username": username})
+		resp, err := http.Post(ts.URL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("login request failed: %v", err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		return resp.StatusCode
+	}
+
+	for ii := 0; ii < 3; ii++ {
+		if status := login("alice"); status != http.StatusOK {
+			t.Fatalf("expected alice's request %d to be allowed, got status %v", ii, status)
+		}
+	}
+	if status := login("alice"); status != http.StatusTooManyRequests {
+		t.Fatalf("expected alice's 4th request to be rate limited, got status %v", status)
+	}
+
+	// A different username is a different key, so it isn't affected by alice's burst
+	if status := login("bob"); status != http.StatusOK {
+		t.Fatalf("expected bob's request to be allowed, got status %v", status)
+	}
+}
+
+// TestE2EQueueHeadDrop bursts far more concurrent requests from one client than its
+// queue depth allows and checks that head-drop overload shedding keeps latency bounded:
+// every request resolves within maxWait plus a small margin, none hang indefinitely, and
+// at least one gets head-dropped.
+func TestE2EQueueHeadDrop(t *testing.T) {
+	numServers := 1
+	queueDepth := 4
+	maxWait := 500 * time.Millisecond
+	numRequests := 50
+
+	server.CreateHttpServers(numServers, server.WithQueue(queueDepth, maxWait))
+	limiter.AddRule(2, time.Second)
+
+	latencies := make([]time.Duration, numRequests)
+	var wg sync.WaitGroup
+	for ii := 0; ii < numRequests; ii++ {
+		wg.Add(1)
+		idx := ii
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			_, _, _ = sendClientRequest(0, 0)
+			latencies[idx] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[int(float64(len(latencies))*0.99)-1]
+	maxLatency := latencies[len(latencies)-1]
+
+	// Generous margin over maxWait for HTTP round-trip and poll-interval granularity.
+	margin := maxWait + time.Second
+	if maxLatency > margin {
+		t.Fatalf("expected bounded latency under head-drop shedding, got max=%v p99=%v (margin %v)",
+			maxLatency, p99, margin)
+	}
+
+	// Confirm the queuing/head-drop path was actually exercised, not just that the
+	// (possibly stale) handler for this endpoint happened to return quickly.
+	metric := server.GetMetric("0")
+	if metric.NumQueued == 0 {
+		t.Fatalf("expected at least one request to be queued under sustained overload, got %+v", metric)
+	}
+	if metric.NumHeadDropped == 0 {
+		t.Fatalf("expected at least one request to be head-dropped under sustained overload, got %+v", metric)
+	}
+
+	server.PrintMetric()
+	server.ResetMetric()
+	server.Shutdown()
+}
+
 func sendClientRequest(clientId, serverEndpoint int) (error, int, time.Duration) {
 	client := http.Client{}
 	url := fmt.Sprintf("http://localhost:%v/endpoint-%v", server.ServerPort, serverEndpoint)
@@ -85,21 +477,22 @@ func sendClientRequest(clientId, serverEndpoint int) (error, int, time.Duration)
 	defer func() {
 		_ = resp.Body.Close()
 	}()
-	if resp.StatusCode == http.StatusTooManyRequests {
-		timeLeftStr := resp.Header.Get("X-RateLimit-Reset")
-		if len(timeLeftStr) > 0 {
-			timeLeft, err := time.ParseDuration(timeLeftStr)
-			if err != nil {
-				return err, -1, -1
-			}
-			return nil, http.StatusTooManyRequests, timeLeft
+
+	// timeLeft is best-effort: not every rejecting code path sets X-RateLimit-Reset (or a
+	// parseable one), but the status code itself must always be trustworthy regardless.
+	timeLeft := time.Duration(-1)
+	if timeLeftStr := resp.Header.Get("X-RateLimit-Reset"); len(timeLeftStr) > 0 {
+		if parsed, err := time.ParseDuration(timeLeftStr); err == nil {
+			timeLeft = parsed
 		}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(body))
 	}
-	fmt.Println(string(body))
-	return nil, http.StatusOK, -1
+	return nil, resp.StatusCode, timeLeft
 }